@@ -0,0 +1,97 @@
+// Optional config file support: default -t/-f values, and per-device/per-layout alias and color rules.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Rule maps a device and/or raw layout name to a short alias and, for the i3bar backend, a color.
+// The first rule in Config.Rules whose Device glob and Layout regex both match (each is optional
+// and matches everything when empty) wins; later rules are not consulted.
+type Rule struct {
+	Device string `json:"device,omitempty"` // glob matched against the device identifier, as in path.Match
+	Layout string `json:"layout,omitempty"` // regex matched against the raw XkbActiveLayoutName
+	Alias  string `json:"alias,omitempty"`  // replacement text; the raw layout name is kept if empty
+	FG     string `json:"fg,omitempty"`     // i3bar foreground color, e.g. "#ffffff"
+	BG     string `json:"bg,omitempty"`     // i3bar background color
+
+	layoutRe *regexp.Regexp
+}
+
+// Config is the shape of $XDG_CONFIG_HOME/sklt/config (or ~/.config/sklt/config).
+type Config struct {
+	Interval string `json:"interval,omitempty"` // same values as the -t flag
+	Format   string `json:"format,omitempty"`   // same as the -f flag
+	Rules    []Rule `json:"rules,omitempty"`
+}
+
+// loadConfig reads and parses the config file. A missing file is not an error: it yields a zero
+// Config, so sklt runs exactly as it did before config files existed.
+func loadConfig() (*Config, error) {
+	path := configPath()
+	if len(path) == 0 {
+		return &Config{}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var c Config
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if len(r.Layout) == 0 {
+			continue
+		}
+		re, err := regexp.Compile(r.Layout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config %s: rule %d: %w", path, i, err)
+		}
+		r.layoutRe = re
+	}
+	return &c, nil
+}
+
+func configPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if len(dir) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "sklt", "config")
+}
+
+// applyRules returns the alias and i3bar colors for a device's raw layout name, or the raw layout
+// name unchanged and no colors if no rule matches.
+func (self *monitor) applyRules(id, layout string) (alias, fg, bg string) {
+	for _, r := range self.rules {
+		if len(r.Device) > 0 {
+			if ok, _ := filepath.Match(r.Device, id); !ok {
+				continue
+			}
+		}
+		if r.layoutRe != nil && !r.layoutRe.MatchString(layout) {
+			continue
+		}
+		alias = layout
+		if len(r.Alias) > 0 {
+			alias = r.Alias
+		}
+		return alias, r.FG, r.BG
+	}
+	return layout, "", ""
+}
@@ -0,0 +1,369 @@
+// Desktop notifications on layout change, spoken directly over the session D-Bus wire protocol.
+// This is not a general D-Bus client: it knows only enough of the protocol (SASL EXTERNAL auth,
+// message marshalling and the subset of types Notify needs) to place one notification per layout
+// change against org.freedesktop.Notifications, the same way sway.go speaks just enough of the i3
+// IPC wire protocol rather than pulling in a library for it.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// A Notifier pops a transient desktop notification for a new layout. Implementations must be safe
+// to call repeatedly from main's select loop; they need not be safe for concurrent use, since that
+// loop is the only caller.
+type Notifier interface {
+	Notify(layout string) error
+}
+
+// notifyConfig holds the -n-icon, -n-timeout and -n-urgency flag values.
+type notifyConfig struct {
+	Icon    string
+	Timeout int32
+	Urgency byte
+}
+
+// dbusNotifier calls org.freedesktop.Notifications.Notify on the session bus found via
+// DBUS_SESSION_BUS_ADDRESS. It reuses the daemon-assigned notification id as replaces_id on every
+// subsequent call so that layout notifications stack rather than pile up on screen.
+type dbusNotifier struct {
+	c          net.Conn
+	r          *bufio.Reader
+	serial     uint32
+	replacesID uint32
+	cfg        notifyConfig
+}
+
+// NewNotifier connects to the session bus and performs the handshake (SASL auth, then the
+// mandatory org.freedesktop.DBus.Hello call) needed before Notify can be called. Any error here is
+// meant to be logged once by the caller, after which notifications are silently disabled.
+func NewNotifier(cfg notifyConfig) (Notifier, error) {
+	path, abstract, err := parseBusAddress(os.Getenv("DBUS_SESSION_BUS_ADDRESS"))
+	if err != nil {
+		return nil, err
+	}
+	if abstract {
+		path = "@" + path
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	n := &dbusNotifier{c: c, r: bufio.NewReader(c), cfg: cfg}
+	if err := n.authenticate(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := n.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// parseBusAddress extracts a unix socket path from a DBUS_SESSION_BUS_ADDRESS value such as
+// "unix:path=/run/user/1000/bus" or "unix:abstract=/tmp/dbus-xxxx,guid=...".
+func parseBusAddress(addr string) (path string, abstract bool, err error) {
+	if len(addr) == 0 {
+		return "", false, errors.New("DBUS_SESSION_BUS_ADDRESS is not set")
+	}
+	for _, transport := range strings.Split(addr, ";") {
+		rest := strings.TrimPrefix(transport, "unix:")
+		if rest == transport {
+			continue
+		}
+		for _, kv := range strings.Split(rest, ",") {
+			if p, ok := strings.CutPrefix(kv, "path="); ok {
+				return p, false, nil
+			}
+			if p, ok := strings.CutPrefix(kv, "abstract="); ok {
+				return p, true, nil
+			}
+		}
+	}
+	return "", false, errors.New("no usable unix transport in DBUS_SESSION_BUS_ADDRESS")
+}
+
+// authenticate performs the SASL EXTERNAL handshake the D-Bus protocol requires before any message
+// may be sent, authenticating as the calling user's uid.
+func (n *dbusNotifier) authenticate() error {
+	if _, err := n.c.Write([]byte{0}); err != nil {
+		return err
+	}
+	uid := fmt.Sprintf("%x", fmt.Sprint(os.Getuid()))
+	if _, err := fmt.Fprintf(n.c, "AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := n.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK") {
+		return fmt.Errorf("D-Bus auth rejected: %s", strings.TrimSpace(line))
+	}
+	_, err = fmt.Fprint(n.c, "BEGIN\r\n")
+	return err
+}
+
+// Notify sends the Notify method call for a new layout and records the returned notification id
+// as replaces_id for the next call.
+func (n *dbusNotifier) Notify(layout string) error {
+	body, err := marshalNotify(n.cfg, n.replacesID, layout)
+	if err != nil {
+		return err
+	}
+	reply, err := n.call("org.freedesktop.Notifications", "/org/freedesktop/Notifications", "org.freedesktop.Notifications", "Notify", body)
+	if err != nil {
+		return err
+	}
+	if len(reply) >= 4 {
+		n.replacesID = binary.LittleEndian.Uint32(reply)
+	}
+	return nil
+}
+
+// call sends a METHOD_CALL message and blocks for the matching reply, returning its body.
+// Unrelated traffic (signals such as NameAcquired, or replies to a call that is no longer in
+// flight) is skipped by matching the REPLY_SERIAL header field against the serial we just sent.
+func (n *dbusNotifier) call(destination, path, iface, member string, body []byte) ([]byte, error) {
+	n.serial++
+	serial := n.serial
+	msg := marshalMethodCall(serial, destination, path, iface, member, body)
+	if _, err := n.c.Write(msg); err != nil {
+		return nil, err
+	}
+	for {
+		typ, fields, replyBody, err := readMessage(n.r)
+		if err != nil {
+			return nil, err
+		}
+		if replySerial, ok := headerReplySerial(fields); !ok || replySerial != serial {
+			continue
+		}
+		switch typ {
+		case msgTypeError:
+			return nil, fmt.Errorf("D-Bus call to %s.%s failed", iface, member)
+		case msgTypeMethodReturn:
+			return replyBody, nil
+		}
+	}
+}
+
+const (
+	msgTypeMethodCall   = 1
+	msgTypeMethodReturn = 2
+	msgTypeError        = 3
+	msgTypeSignal       = 4
+)
+
+// readMessage reads one little-endian D-Bus message and returns its type, its raw header fields
+// (for headerReplySerial) and its body.
+func readMessage(r *bufio.Reader) (byte, []byte, []byte, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return 0, nil, nil, err
+	}
+	if fixed[0] != 'l' {
+		return 0, nil, nil, errors.New("unsupported D-Bus byte order in reply")
+	}
+	typ := fixed[1]
+	bodyLen := binary.LittleEndian.Uint32(fixed[4:8])
+	fieldsLen := binary.LittleEndian.Uint32(fixed[12:16])
+	fields := make([]byte, fieldsLen)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return 0, nil, nil, err
+	}
+	pad := (8 - (16+int(fieldsLen))%8) % 8
+	if pad > 0 {
+		if _, err := io.ReadFull(r, make([]byte, pad)); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, nil, err
+	}
+	return typ, fields, body, nil
+}
+
+// headerReplySerial scans a message's header fields (as returned by readMessage) for the
+// REPLY_SERIAL field (code 5, signature "u"), which only METHOD_RETURN and ERROR messages carry.
+func headerReplySerial(fields []byte) (uint32, bool) {
+	pos := 0
+	align := func(n int) {
+		if r := pos % n; r != 0 {
+			pos += n - r
+		}
+	}
+	for pos < len(fields) {
+		align(8)
+		if pos >= len(fields) {
+			break
+		}
+		code := fields[pos]
+		pos++
+		if pos >= len(fields) {
+			break
+		}
+		sigLen := int(fields[pos])
+		pos++
+		sig := string(fields[pos : pos+sigLen])
+		pos += sigLen + 1 // signature bytes plus its terminating NUL
+		switch sig {
+		case "u":
+			align(4)
+			v := binary.LittleEndian.Uint32(fields[pos : pos+4])
+			pos += 4
+			if code == 5 {
+				return v, true
+			}
+		case "s", "o":
+			align(4)
+			strLen := int(binary.LittleEndian.Uint32(fields[pos : pos+4]))
+			pos += 4 + strLen + 1
+		case "g":
+			sl := int(fields[pos])
+			pos++
+			pos += sl + 1
+		default:
+			return 0, false // a header field type this minimal parser doesn't know about
+		}
+	}
+	return 0, false
+}
+
+// marshaller builds a little-endian D-Bus value stream with the protocol's alignment rules.
+type marshaller struct{ buf bytes.Buffer }
+
+func (m *marshaller) align(n int) {
+	for m.buf.Len()%n != 0 {
+		m.buf.WriteByte(0)
+	}
+}
+
+func (m *marshaller) byte(b byte) { m.buf.WriteByte(b) }
+
+func (m *marshaller) uint32(v uint32) {
+	m.align(4)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	m.buf.Write(b[:])
+}
+
+func (m *marshaller) int32(v int32) { m.uint32(uint32(v)) }
+
+func (m *marshaller) string(s string) {
+	m.uint32(uint32(len(s)))
+	m.buf.WriteString(s)
+	m.buf.WriteByte(0)
+}
+
+func (m *marshaller) signature(s string) {
+	m.buf.WriteByte(byte(len(s)))
+	m.buf.WriteString(s)
+	m.buf.WriteByte(0)
+}
+
+// stringArray marshals "as".
+func (m *marshaller) stringArray(ss []string) {
+	m.align(4)
+	lenPos := m.buf.Len()
+	m.uint32(0)
+	start := m.buf.Len()
+	for _, s := range ss {
+		m.string(s)
+	}
+	patchUint32(&m.buf, lenPos, uint32(m.buf.Len()-start))
+}
+
+// byteHint marshals "a{sv}" containing at most the single "urgency" hint Notify's -n-urgency flag sets.
+func (m *marshaller) byteHint(key string, value byte, have bool) {
+	m.align(4)
+	lenPos := m.buf.Len()
+	m.uint32(0)
+	m.align(8)
+	start := m.buf.Len()
+	if have {
+		m.align(8)
+		m.string(key)
+		m.signature("y")
+		m.byte(value)
+	}
+	patchUint32(&m.buf, lenPos, uint32(m.buf.Len()-start))
+}
+
+func patchUint32(buf *bytes.Buffer, pos int, v uint32) {
+	binary.LittleEndian.PutUint32(buf.Bytes()[pos:pos+4], v)
+}
+
+// marshalNotify builds the body of a Notify call, signature "susssasa{sv}i".
+func marshalNotify(cfg notifyConfig, replacesID uint32, layout string) ([]byte, error) {
+	var m marshaller
+	m.string("sklt")
+	m.uint32(replacesID)
+	m.string(cfg.Icon)
+	m.string(layout)
+	m.string("")
+	m.stringArray(nil)
+	m.byteHint("urgency", cfg.Urgency, true)
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 1500
+	}
+	m.int32(timeout)
+	return m.buf.Bytes(), nil
+}
+
+// headerField marshals one struct(yv) entry of the message header's array of header fields.
+func headerField(m *marshaller, code byte, sig string, write func(*marshaller)) {
+	m.align(8)
+	m.byte(code)
+	m.signature(sig)
+	write(m)
+}
+
+// marshalMethodCall builds a complete METHOD_CALL message, header and body, ready to write to the bus.
+func marshalMethodCall(serial uint32, destination, path, iface, member string, body []byte) []byte {
+	var fields marshaller
+	headerField(&fields, 1, "o", func(m *marshaller) { m.string(path) })
+	headerField(&fields, 2, "s", func(m *marshaller) { m.string(iface) })
+	headerField(&fields, 3, "s", func(m *marshaller) { m.string(member) })
+	headerField(&fields, 6, "s", func(m *marshaller) { m.string(destination) })
+	if len(body) > 0 {
+		headerField(&fields, 8, "g", func(m *marshaller) { m.signature(bodySignature(member)) })
+	}
+
+	var h marshaller
+	h.byte('l')
+	h.byte(msgTypeMethodCall)
+	h.byte(0)
+	h.byte(1)
+	h.uint32(uint32(len(body)))
+	h.uint32(serial)
+	h.uint32(0) // placeholder for the a(yv) array length, patched below
+	lenPos := h.buf.Len() - 4
+	h.align(8)
+	start := h.buf.Len()
+	h.buf.Write(fields.buf.Bytes())
+	patchUint32(&h.buf, lenPos, uint32(h.buf.Len()-start))
+	h.align(8)
+
+	out := h.buf.Bytes()
+	return append(out, body...)
+}
+
+func bodySignature(member string) string {
+	if member == "Notify" {
+		return "susssasa{sv}i"
+	}
+	return ""
+}
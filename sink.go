@@ -0,0 +1,189 @@
+// Status-line backends: swaybar/tmux/lemonbar plain text, the i3bar JSON protocol and Waybar's custom module protocol.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A StatusSink renders one status update for a particular bar protocol.
+type StatusSink interface {
+	// Render outputs one status update. layout may be empty if no layout change has been observed
+	// yet. fg/bg are the i3bar colors a config rule attached to layout, if any; sinks that don't
+	// speak a colored protocol ignore them.
+	Render(layout, fg, bg, t string) error
+}
+
+// defaultStatusFormat is the formatSink template used when -status-format is not given; it
+// reproduces sklt's original plain-text output.
+const defaultStatusFormat = "{layout} {time}"
+
+// NewStatusSink returns the StatusSink for the named backend. An empty name selects the original
+// swaybar behavior. format is the template formatSink expands for the tmux/lemonbar backends;
+// i3barNoSeparator suppresses i3bar's separator between the layout and time blocks. Both are
+// ignored by backends they don't apply to.
+func NewStatusSink(name string, m *monitor, format string, i3barNoSeparator bool) (StatusSink, error) {
+	switch name {
+	case "", "swaybar":
+		return &plainSink{}, nil
+	case "tmux", "lemonbar":
+		return &formatSink{format: format}, nil
+	case "i3bar":
+		return newI3barSink(m, i3barNoSeparator), nil
+	case "waybar":
+		return &waybarSink{}, nil
+	}
+	return nil, fmt.Errorf("unknown status backend: %s", name)
+}
+
+// plainSink reproduces sklt's original output: one plain text line per update, consumed as-is by swaybar.
+type plainSink struct{}
+
+func (*plainSink) Render(layout, fg, bg, t string) error {
+	status := t
+	if len(layout) > 0 {
+		status = layout + " " + t
+	}
+	status += "\n"
+	n, err := io.WriteString(os.Stdout, status)
+	if err == nil && n < len(status) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// formatSink is tmux/lemonbar's configurable format-string mode: each update expands format,
+// replacing the literal placeholders {layout} and {time}, and trims leading and trailing whitespace
+// from the result, so an empty layout (no change observed yet) at either end of the template leaves
+// no stray whitespace. Whitespace inside the result is kept as is.
+type formatSink struct{ format string }
+
+func (s *formatSink) Render(layout, fg, bg, t string) error {
+	status := strings.ReplaceAll(strings.ReplaceAll(s.format, "{layout}", layout), "{time}", t)
+	status = strings.TrimSpace(status) + "\n"
+	n, err := io.WriteString(os.Stdout, status)
+	if err == nil && n < len(status) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// waybarBlock is the JSON object Waybar's custom module protocol expects, one per line.
+// percentage is omitted: it has no meaningful value for a layout/time display.
+type waybarBlock struct {
+	Text    string `json:"text"`
+	Tooltip string `json:"tooltip"`
+	Class   string `json:"class"`
+}
+
+type waybarSink struct{}
+
+func (*waybarSink) Render(layout, fg, bg, t string) error {
+	class := "time"
+	if len(layout) > 0 {
+		class = "layout"
+	}
+	b, err := json.Marshal(waybarBlock{
+		Text:    strings.TrimSpace(layout + " " + t),
+		Tooltip: layout,
+		Class:   class,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(b))
+	return err
+}
+
+// i3barBlock is one element of the block array i3bar expects per status line, as documented at
+// https://i3wm.org/docs/i3bar-protocol.html. Separator is a pointer so that explicitly disabling
+// the separator (false) can be distinguished from leaving it at i3bar's own default (true), which
+// omitempty would otherwise conflate with the bool zero value.
+type i3barBlock struct {
+	FullText   string `json:"full_text"`
+	Color      string `json:"color,omitempty"`
+	Background string `json:"background,omitempty"`
+	Separator  *bool  `json:"separator,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Instance   string `json:"instance,omitempty"`
+}
+
+// separatorOff is shared by every block that wants to explicitly disable its separator, since
+// Separator needs the address of a false value rather than false itself.
+var separatorOff = false
+
+// i3barSink speaks the full i3bar JSON protocol: a header line, an opening '[' and then a
+// comma-separated, never-closed stream of block arrays. i3/sway deliver SIGSTOP/SIGCONT to pause
+// and resume the status command while the bar is hidden; the kernel suspends sklt's own goroutines
+// for the duration, so no extra handling is required here beyond not losing the leading-comma state.
+type i3barSink struct {
+	m           *monitor
+	first       bool
+	noSeparator bool // suppress the separator between the layout and time blocks
+}
+
+func newI3barSink(m *monitor, noSeparator bool) *i3barSink {
+	fmt.Println(`{"version":1,"click_events":true}`)
+	fmt.Println("[")
+	s := &i3barSink{m: m, first: true, noSeparator: noSeparator}
+	go s.listenClicks()
+	return s
+}
+
+func (s *i3barSink) Render(layout, fg, bg, t string) error {
+	var blocks []i3barBlock
+	if len(layout) > 0 {
+		b := i3barBlock{FullText: layout, Color: fg, Background: bg, Name: "layout", Instance: "layout"}
+		if s.noSeparator {
+			b.Separator = &separatorOff
+		}
+		blocks = append(blocks, b)
+	}
+	blocks = append(blocks, i3barBlock{FullText: t, Name: "time"})
+	b, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	prefix := ","
+	if s.first {
+		prefix = ""
+		s.first = false
+	}
+	_, err = fmt.Println(prefix + string(b))
+	return err
+}
+
+// i3barClick is the subset of i3bar's click-event fields sklt reacts to.
+type i3barClick struct {
+	Name string `json:"name"`
+}
+
+// listenClicks reads the click-event array i3bar/sway write to our stdin and cycles the active
+// layout when the layout block is clicked.
+func (s *i3barSink) listenClicks() {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		line = strings.TrimPrefix(line, "[")
+		line = strings.TrimPrefix(line, ",")
+		line = strings.TrimSuffix(line, ",")
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			var c i3barClick
+			if jerr := json.Unmarshal([]byte(line), &c); jerr == nil && c.Name == "layout" {
+				if cerr := s.m.cycleLayout(); cerr != nil {
+					fmt.Fprintln(os.Stderr, "failed to cycle layout:", cerr)
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
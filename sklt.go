@@ -2,18 +2,25 @@
 // Sway has per-device layouts. This program outputs only the last layout that changed.
 // When a new device is connected, its initial layout is shown.
 // For command line reference, run:
-//    sklt -h
+//
+//	sklt -h
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -26,7 +33,7 @@ func usage(e bool) {
 	} else {
 		w = os.Stdout
 	}
-	fmt.Fprintln(w, "usage:", progName, "[-h] [-t interval] [-f format]")
+	fmt.Fprintln(w, "usage:", progName, "[-h] [-t interval] [-f format] [-p backend]")
 	fmt.Fprintln(w, "\t-h - print this message and exit")
 	fmt.Fprintln(w, "\t-t interval - time update interval; valid values are (case-insensitive):")
 	fmt.Fprintln(w, "\t\ts or second")
@@ -37,22 +44,115 @@ func usage(e bool) {
 	fmt.Fprintln(w, "\t\tthat is, how the time \"Mon Jan 2 15:04:05 -0700 MST 2006\" should be formatted")
 	fmt.Fprintln(w, "\t\tsee https://golang.org/pkg/time/#Time.Format")
 	fmt.Fprintln(w, "\t\texample: \"2006-01-02 15:04\" (year-month-day hour:minute)")
+	fmt.Fprintln(w, "\t-p backend - status output protocol (default: swaybar)")
+	fmt.Fprintln(w, "\t\tone of: swaybar, i3bar, waybar, tmux, lemonbar")
+	fmt.Fprintln(w, "\t\ti3bar also reacts to clicks on the layout block by cycling to the next layout")
+	fmt.Fprintln(w, "\t-status-format tmpl - tmux/lemonbar output template (default: \"{layout} {time}\")")
+	fmt.Fprintln(w, "\t\t{layout} and {time} are replaced; leading and trailing whitespace is trimmed,")
+	fmt.Fprintln(w, "\t\tso an empty layout at either end of the template leaves no stray whitespace")
+	fmt.Fprintln(w, "\t-i3bar-no-separator - merge the i3bar layout and time blocks by disabling the separator between them")
+	fmt.Fprintln(w, "\t-wm sway|i3|auto - window manager to connect to (default: auto)")
+	fmt.Fprintln(w, "\t\tauto tries Sway first, then falls back to i3")
+	fmt.Fprintln(w, "\t-n - pop a desktop notification on every layout change")
+	fmt.Fprintln(w, "\t-n-icon name - icon name or path passed to the notification (default: none)")
+	fmt.Fprintln(w, "\t-n-timeout ms - notification expire timeout in milliseconds (default: 1500)")
+	fmt.Fprintln(w, "\t-n-urgency low|normal|critical - notification urgency (default: normal)")
+	fmt.Fprintln(w, "\t-disconnected-text text - layout text shown while reconnecting to the window manager (default: ?)")
+	fmt.Fprintln(w, "\tconfig file: $XDG_CONFIG_HOME/sklt/config, or ~/.config/sklt/config if unset")
+	fmt.Fprintln(w, "\t\tJSON object with optional \"interval\", \"format\" (same meaning as -t/-f, overridden by them)")
+	fmt.Fprintln(w, "\t\tand \"rules\": a list of {\"device\", \"layout\", \"alias\", \"fg\", \"bg\"}, first match wins")
+	fmt.Fprintln(w, "\t\tdevice is a glob matched against the device identifier, layout is a regex matched")
+	fmt.Fprintln(w, "\t\tagainst the raw layout name; alias replaces it, fg/bg color the i3bar layout block")
 	if e {
 		os.Exit(1)
 	}
 }
 
+// i3 reports the active layout per focused window rather than per input device, so its input
+// events carry no identifier. deviceID substitutes a synthetic one so the monitor's existing
+// per-device bookkeeping keeps working unchanged.
+const fallbackDeviceID = "i3-window"
+
+func deviceID(id string) string {
+	if len(id) == 0 {
+		return fallbackDeviceID
+	}
+	return id
+}
+
 // Keyboards are organized in a doubly linked list in the order of recent layout changes.
-type kbdDev struct{ layout, prevDev, nextDev string }
+// fg and bg are set alongside layout by monitor.set when a config rule matches.
+type kbdDev struct{ layout, prevDev, nextDev, fg, bg string }
+
+// A layoutUpdate is what monitor sends over ch: the layout text plus any i3bar colors a config rule
+// attached to it. Carrying colors alongside the layout lets sinks render without reaching back into
+// monitor.kbds, which is mutated from a different goroutine.
+type layoutUpdate struct{ layout, fg, bg string }
 
-// Monitors Sway keyboard layouts.
+// Monitors Sway or i3 keyboard layouts. Run's goroutine owns kbds, prevUpdate and backoff outright.
+// s and lastKbd are also read by cycleLayout, called from a status sink's click-listener goroutine,
+// so those two fields are only ever touched through mu and the accessor/writeIPC methods below.
 type monitor struct {
-	s                   net.Conn          // Sway IPC socket
-	ch                  chan string       // layout change notifications
-	kbds                map[string]kbdDev // indexed by device identifiers
-	lastKbd, prevLayout string
+	mu               sync.Mutex
+	s                net.Conn                 // Sway/i3 IPC socket, guarded by mu
+	lastKbd          string                   // guarded by mu
+	dial             func() (net.Conn, error) // (re)connects to the window manager
+	disconnectedText string                   // layout placeholder shown while reconnecting
+	ch               chan layoutUpdate        // layout change notifications
+	kbds             map[string]kbdDev        // indexed by device identifiers
+	prevUpdate       layoutUpdate
+	backoff          time.Duration // current reconnect delay, reset once SUBSCRIBE is acked
+	rules            []Rule        // alias/color rules from the config file
+}
+
+// getLastKbd and setLastKbd give synchronized access to the most recently active device identifier.
+func (self *monitor) getLastKbd() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.lastKbd
+}
+
+func (self *monitor) setLastKbd(id string) {
+	self.mu.Lock()
+	self.lastKbd = id
+	self.mu.Unlock()
+}
+
+// setSocket and closeSocket install or tear down the IPC connection cycleLayout writes to.
+func (self *monitor) setSocket(c net.Conn) {
+	self.mu.Lock()
+	self.s = c
+	self.mu.Unlock()
 }
 
+func (self *monitor) closeSocket() {
+	self.mu.Lock()
+	c := self.s
+	self.s = nil
+	self.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// writeIPC serializes f against the connection's other writers so the session goroutine and
+// click-driven cycleLayout calls never interleave bytes on the wire. It is a no-op while
+// disconnected.
+func (self *monitor) writeIPC(f func(net.Conn) error) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.s == nil {
+		return nil
+	}
+	return f(self.s)
+}
+
+// Reconnect delay bounds for monitor.Run.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
 // Delete a keyboard from the list.
 func (self *monitor) del(id string) {
 	if len(id) == 0 {
@@ -73,26 +173,29 @@ func (self *monitor) del(id string) {
 		l2.prevDev = l1.prevDev
 		self.kbds[l1.nextDev] = l2
 	}
-	if self.lastKbd == id {
-		self.lastKbd = l1.prevDev
+	if self.getLastKbd() == id {
+		self.setLastKbd(l1.prevDev)
 	}
 }
 
 // Set keyboard's layout in the list. If the layout has changed or the identifier is new, put the keyboard at the end of the list.
+// The raw layout name is passed through any matching config rule, which may replace it with a
+// short alias and attach i3bar colors, before it is stored or sent anywhere.
 func (self *monitor) set(id, l string) {
 	if len(l) == 0 {
 		self.del(id)
 		return
 	}
+	alias, fg, bg := self.applyRules(id, l)
 	if self.kbds == nil {
 		self.kbds = make(map[string]kbdDev)
 	}
 	l1 := self.kbds[id]
-	if l1.layout == l {
+	if l1.layout == alias && l1.fg == fg && l1.bg == bg {
 		return
 	}
-	l1.layout = l
-	if self.lastKbd != id {
+	l1.layout, l1.fg, l1.bg = alias, fg, bg
+	if last := self.getLastKbd(); last != id {
 		if len(l1.prevDev) > 0 {
 			l2 := self.kbds[l1.prevDev]
 			l2.nextDev = l1.nextDev
@@ -103,9 +206,9 @@ func (self *monitor) set(id, l string) {
 			l2.prevDev = l1.prevDev
 			self.kbds[l1.nextDev] = l2
 		}
-		l1.prevDev = self.lastKbd
+		l1.prevDev = last
 		l1.nextDev = ""
-		self.lastKbd = id
+		self.setLastKbd(id)
 	}
 	self.kbds[id] = l1
 }
@@ -123,7 +226,8 @@ func (self *monitor) processMsg(t MessageType, payload io.Reader) error {
 		if !p.Success {
 			return errors.New("failed to subscribe to Sway events")
 		}
-		err = WriteEmptyMessage(self.s, GET_INPUTS)
+		self.backoff = minBackoff
+		err = self.writeIPC(func(c net.Conn) error { return WriteEmptyMessage(c, GET_INPUTS) })
 		if err != nil {
 			return err
 		}
@@ -134,7 +238,7 @@ func (self *monitor) processMsg(t MessageType, payload io.Reader) error {
 			return err
 		}
 		for _, i := range p {
-			self.set(i.Identifier, i.XkbActiveLayoutName)
+			self.set(deviceID(i.Identifier), i.XkbActiveLayoutName)
 		}
 	case InputEvent:
 		var p InputEventPayload
@@ -144,35 +248,133 @@ func (self *monitor) processMsg(t MessageType, payload io.Reader) error {
 		}
 		switch p.Change {
 		case "removed":
-			self.del(p.Input.Identifier)
+			self.del(deviceID(p.Input.Identifier))
 		default:
-			self.set(p.Input.Identifier, p.Input.XkbActiveLayoutName)
+			self.set(deviceID(p.Input.Identifier), p.Input.XkbActiveLayoutName)
 		}
 	}
 	return nil
 }
 
-func (self *monitor) watchLayouts() {
-	err := WriteJSONMessage(self.s, SUBSCRIBE, []string{"input"})
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to send Sway message:", err)
-		os.Exit(1)
+// cycleLayout asks Sway to switch the most recently active input to its next configured keyboard layout.
+// It is used to let status bars react to clicks on the layout block, from a goroutine separate from
+// the one running Run/session.
+func (self *monitor) cycleLayout() error {
+	id := self.getLastKbd()
+	if len(id) == 0 {
+		return nil
 	}
-	for {
-		err = ReadMessage(self.s, self.processMsg)
+	return self.writeIPC(func(c net.Conn) error {
+		return WriteMessage(c, RUN_COMMAND, []byte("input "+id+" xkb_switch_layout next"))
+	})
+}
+
+// Run connects to the window manager and streams layout changes into ch until ctx is canceled,
+// reconnecting with exponential backoff and jitter whenever the IPC connection is lost (e.g. Sway
+// restarting or reloading). If stopIfNoIPC is set, Run gives up without retrying when the very
+// first connection attempt fails because no IPC socket could be found at all, rather than when the
+// window manager is merely unreachable right now.
+func (self *monitor) Run(ctx context.Context, stopIfNoIPC bool) {
+	self.backoff = minBackoff
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		c, err := self.dial()
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Sway IPC failure:", err)
-			os.Exit(1)
+			if attempt == 0 && stopIfNoIPC && err == ErrNoIPC {
+				return
+			}
+			if !self.waitAndBackoff(ctx) {
+				return
+			}
+			continue
+		}
+		self.setSocket(c)
+		err = self.session(ctx, c)
+		self.closeSocket()
+		self.kbds = nil
+		self.setLastKbd("")
+		if ctx.Err() != nil {
+			return
+		}
+		if !self.waitAndBackoff(ctx) {
+			return
 		}
-		nl := self.kbds[self.lastKbd].layout
-		if self.prevLayout == nl {
+	}
+}
+
+// session subscribes to input events over c, an already-connected socket also installed as self.s,
+// and feeds layout changes to ch until the connection fails or ctx is canceled, in which case it
+// returns nil.
+func (self *monitor) session(ctx context.Context, c net.Conn) error {
+	if err := self.writeIPC(func(c net.Conn) error { return WriteJSONMessage(c, SUBSCRIBE, []string{"input"}) }); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		if err := ReadMessage(c, self.processMsg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		dev := self.kbds[self.getLastKbd()]
+		u := layoutUpdate{layout: dev.layout, fg: dev.fg, bg: dev.bg}
+		if self.prevUpdate == u {
 			continue
 		}
-		self.prevLayout = nl
-		self.ch <- nl
+		self.prevUpdate = u
+		self.pushLayout(ctx, u)
 	}
 }
 
+// pushLayout sends a layout update to ch, giving up if ctx is canceled first.
+func (self *monitor) pushLayout(ctx context.Context, u layoutUpdate) {
+	select {
+	case self.ch <- u:
+	case <-ctx.Done():
+	}
+}
+
+// waitAndBackoff announces the outage via disconnectedText, sleeps for a jittered backoff and
+// advances it towards maxBackoff. It returns false if ctx was canceled during the wait.
+func (self *monitor) waitAndBackoff(ctx context.Context) bool {
+	self.prevUpdate = layoutUpdate{}
+	self.pushLayout(ctx, layoutUpdate{layout: self.disconnectedText})
+	if !sleepContext(ctx, jitter(self.backoff)) {
+		return false
+	}
+	self.backoff *= 2
+	if self.backoff > maxBackoff {
+		self.backoff = maxBackoff
+	}
+	return true
+}
+
+// sleepContext waits for d, or returns false early if ctx is canceled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// jitter returns a random duration in [d/2, d], so simultaneous clients don't reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half+1)))
+}
+
 func timer(interval time.Duration, ch chan<- time.Time) {
 	for {
 		t := time.Now()
@@ -184,6 +386,21 @@ func timer(interval time.Duration, ch chan<- time.Time) {
 	}
 }
 
+// parseInterval parses the values the -t flag and the config file's "interval" key accept.
+func parseInterval(s string) (time.Duration, error) {
+	switch strings.ToLower(s) {
+	case "s", "second":
+		return time.Second, nil
+	case "m", "minute":
+		return time.Minute, nil
+	case "h", "hour":
+		return time.Hour, nil
+	case "d", "day":
+		return 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid interval: %s", s)
+}
+
 func getArg(i *int) string {
 	if *i > len(os.Args)-2 {
 		fmt.Fprintln(os.Stderr, "missing value for the parameter", os.Args[*i])
@@ -200,8 +417,28 @@ func main() {
 			progName = p
 		}
 	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	interval := time.Minute
-	var format string
+	statusFormat := defaultStatusFormat
+	var format, backend, wm string
+	var notify, i3barNoSeparator bool
+	ncfg := notifyConfig{Urgency: 1}
+	disconnectedText := "?"
+	if len(cfg.Interval) > 0 {
+		iv, err := parseInterval(cfg.Interval)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "config:", err)
+			os.Exit(1)
+		}
+		interval = iv
+	}
+	if len(cfg.Format) > 0 {
+		format = cfg.Format
+	}
 	for i := 1; i < len(os.Args); i++ {
 		switch os.Args[i] {
 		case "-h", "--help":
@@ -209,21 +446,57 @@ func main() {
 			return
 		case "-t":
 			ti := getArg(&i)
-			switch strings.ToLower(ti) {
-			case "s", "second":
-				interval = time.Second
-			case "m", "minute":
-				interval = time.Minute
-			case "h", "hour":
-				interval = time.Hour
-			case "d", "day":
-				interval = 24 * time.Hour
-			default:
-				fmt.Fprintln(os.Stderr, "invalid interval:", ti)
+			iv, err := parseInterval(ti)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
 				usage(true)
 			}
+			interval = iv
 		case "-f":
 			format = getArg(&i)
+		case "-p":
+			backend = getArg(&i)
+		case "-status-format":
+			statusFormat = getArg(&i)
+		case "-i3bar-no-separator":
+			i3barNoSeparator = true
+		case "-wm":
+			wm = getArg(&i)
+			switch wm {
+			case "sway", "i3":
+			case "auto":
+				wm = ""
+			default:
+				fmt.Fprintln(os.Stderr, "invalid window manager:", wm)
+				usage(true)
+			}
+		case "-n":
+			notify = true
+		case "-n-icon":
+			ncfg.Icon = getArg(&i)
+		case "-n-timeout":
+			ti := getArg(&i)
+			v, err := strconv.Atoi(ti)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "invalid notification timeout:", ti)
+				usage(true)
+			}
+			ncfg.Timeout = int32(v)
+		case "-disconnected-text":
+			disconnectedText = getArg(&i)
+		case "-n-urgency":
+			u := getArg(&i)
+			switch u {
+			case "low":
+				ncfg.Urgency = 0
+			case "normal":
+				ncfg.Urgency = 1
+			case "critical":
+				ncfg.Urgency = 2
+			default:
+				fmt.Fprintln(os.Stderr, "invalid notification urgency:", u)
+				usage(true)
+			}
 		default:
 			fmt.Fprintln(os.Stderr, "unknown parameter:", os.Args[i])
 			usage(true)
@@ -244,35 +517,56 @@ func main() {
 	if interval > time.Hour {
 		interval = time.Hour
 	}
-	m := monitor{ch: make(chan string)}
-	var err error
-	m.s, err = Connect("")
-	if err != nil && err != ErrNoIPC {
-		fmt.Fprintln(os.Stderr, "failed to connect to Sway:", err)
-		os.Exit(1)
+	m := monitor{
+		ch:               make(chan layoutUpdate),
+		disconnectedText: disconnectedText,
+		dial:             func() (net.Conn, error) { return Dialer{WM: wm}.Dial() },
+		rules:            cfg.Rules,
 	}
-	if m.s != nil {
-		go m.watchLayouts()
-		format = " " + format
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+	go m.Run(ctx, len(wm) == 0)
+	sink, err := NewStatusSink(strings.ToLower(backend), &m, statusFormat, i3barNoSeparator)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage(true)
+	}
+	var notifier Notifier
+	if notify {
+		notifier, err = NewNotifier(ncfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "desktop notifications disabled:", err)
+		}
 	}
-	format += "\n"
 	tch := make(chan time.Time, 1)
 	go timer(interval, tch)
 	var t time.Time
-	var layout, prevStatus string
+	var update layoutUpdate
+	var prevStatus string
 	for {
 		select {
-		case layout = <-m.ch:
+		case <-ctx.Done():
+			return
+		case update = <-m.ch:
 			t = time.Now()
+			if notifier != nil {
+				if err := notifier.Notify(update.layout); err != nil {
+					fmt.Fprintln(os.Stderr, "desktop notifications disabled:", err)
+					notifier = nil
+				}
+			}
 		case t = <-tch:
 		}
-		status := layout + t.Format(format)
+		ts := t.Format(format)
+		status := update.layout + "\x00" + update.fg + "\x00" + update.bg + "\x00" + ts
 		if status != prevStatus {
-			n, err := io.WriteString(os.Stdout, status)
-			if err == nil && n < len(status) {
-				err = io.ErrShortWrite
-			}
-			if err != nil {
+			if err := sink.Render(update.layout, update.fg, update.bg, ts); err != nil {
 				fmt.Fprintln(os.Stderr, "failed to output status line:", err)
 				os.Exit(1)
 			}
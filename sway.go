@@ -1,4 +1,4 @@
-// Sway IPC
+// Sway and i3 IPC. Both window managers speak the same wire protocol; only socket discovery differs.
 
 package main
 
@@ -10,6 +10,9 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 // Magic is Sway message magic string.
@@ -20,9 +23,10 @@ type MessageType uint32
 
 // Needed Sway message type codes.
 const (
-	SUBSCRIBE  MessageType = 2
-	GET_INPUTS MessageType = 100
-	InputEvent             = 0x80000015
+	RUN_COMMAND MessageType = 0
+	SUBSCRIBE   MessageType = 2
+	GET_INPUTS  MessageType = 100
+	InputEvent              = 0x80000015
 )
 
 // A MessageHeader contains a Sway message excluding the payload.
@@ -59,38 +63,106 @@ func WriteEmptyMessage(w io.Writer, t MessageType) error {
 	return binary.Write(w, ByteOrder, MessageHeader{Magic: Magic, Type: t})
 }
 
-// WriteJSONMessage sends a Sway message with JSON-encoded payload.
-func WriteJSONMessage(w io.Writer, t MessageType, p interface{}) error {
-	b, err := json.Marshal(p)
+// WriteMessage sends a Sway message with a raw payload.
+func WriteMessage(w io.Writer, t MessageType, p []byte) error {
+	err := binary.Write(w, ByteOrder, MessageHeader{Magic: Magic, Length: uint32(len(p)), Type: t})
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, ByteOrder, MessageHeader{Magic: Magic, Length: uint32(len(b)), Type: t})
+	n, err := w.Write(p)
 	if err != nil {
 		return err
 	}
-	n, err := w.Write(b)
+	if n < len(p) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// WriteJSONMessage sends a Sway message with JSON-encoded payload.
+func WriteJSONMessage(w io.Writer, t MessageType, p interface{}) error {
+	b, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
-	if n < len(b) {
-		return io.ErrShortWrite
+	return WriteMessage(w, t, b)
+}
+
+// ErrNoIPC is returned when the IPC socket path of the selected window manager could not be
+// determined; when probing both, it is returned only if neither Sway's nor i3's path is known.
+var ErrNoIPC = errors.New("IPC socket path is unknown")
+
+// A Dialer discovers and connects to a Sway or i3 IPC socket. WM selects which window manager to
+// talk to: "sway", "i3", or "" to probe Sway first and fall back to i3.
+type Dialer struct{ WM string }
+
+// Dial discovers the IPC socket path and connects to it.
+func (d Dialer) Dial() (net.Conn, error) {
+	path, err := d.socketPath()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return net.Dial("unix", path)
+}
+
+func (d Dialer) socketPath() (string, error) {
+	switch d.WM {
+	case "sway":
+		return swaySocketPath()
+	case "i3":
+		return i3SocketPath()
+	}
+	if path, err := swaySocketPath(); err == nil {
+		return path, nil
+	}
+	return i3SocketPath()
 }
 
-// ErrNoIPC is returned when Sway IPC socket path is not specified either explicitly or via the environment variable.
-var ErrNoIPC = errors.New("Sway IPC socket path is unknown")
+func swaySocketPath() (string, error) {
+	path := os.Getenv("SWAYSOCK")
+	if len(path) == 0 {
+		path = socketPathFromCommand("sway")
+	}
+	if len(path) == 0 {
+		return "", ErrNoIPC
+	}
+	return path, nil
+}
 
-// Connect makes a connection to Sway IPC socket. If path is empty, SWAYSOCK environment variable is used.
-func Connect(path string) (net.Conn, error) {
+// i3SocketPath locates i3's IPC socket the same way i3-msg does: the I3SOCK environment variable,
+// then `i3 --get-socketpath`, then a path i3 may have recorded under ~/.config/i3 as a last resort.
+func i3SocketPath() (string, error) {
+	path := os.Getenv("I3SOCK")
 	if len(path) == 0 {
-		path = os.Getenv("SWAYSOCK")
+		path = socketPathFromCommand("i3")
 	}
 	if len(path) == 0 {
-		return nil, ErrNoIPC
+		path = i3SocketFromConfigDir()
 	}
-	return net.Dial("unix", path)
+	if len(path) == 0 {
+		return "", ErrNoIPC
+	}
+	return path, nil
+}
+
+func socketPathFromCommand(wm string) string {
+	out, err := exec.Command(wm, "--get-socketpath").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func i3SocketFromConfigDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	matches, _ := filepath.Glob(filepath.Join(home, ".config", "i3", "ipc-socket.*"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
 }
 
 // An InputDevice contains Sway input device data.